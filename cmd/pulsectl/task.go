@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/intelsdi-x/pulse/mgmt/rest/client"
@@ -19,6 +26,252 @@ import (
 	"github.com/ghodss/yaml"
 )
 
+// maxWatchBackoff caps logsTask's reconnect delay.
+const maxWatchBackoff = 30 * time.Second
+
+type cliErrorKind int
+
+const (
+	usageError cliErrorKind = iota + 2
+	fileIOError
+	parseError
+	serverError
+	notFoundError
+)
+
+func (k cliErrorKind) exitCode() int { return int(k) }
+
+func (k cliErrorKind) jsonKind() string {
+	switch k {
+	case usageError:
+		return "usage"
+	case fileIOError:
+		return "file_io"
+	case parseError:
+		return "parse"
+	case serverError:
+		return "server"
+	case notFoundError:
+		return "not_found"
+	default:
+		return "error"
+	}
+}
+
+type cliError struct {
+	kind cliErrorKind
+	msg  string
+}
+
+func (e *cliError) Error() string { return e.msg }
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &cliError{kind: usageError, msg: fmt.Sprintf(format, a...)}
+}
+
+func fileErrorf(format string, a ...interface{}) error {
+	return &cliError{kind: fileIOError, msg: fmt.Sprintf(format, a...)}
+}
+
+func parseErrorf(format string, a ...interface{}) error {
+	return &cliError{kind: parseError, msg: fmt.Sprintf(format, a...)}
+}
+
+func serverErrorf(format string, a ...interface{}) error {
+	return &cliError{kind: serverError, msg: fmt.Sprintf(format, a...)}
+}
+
+func notFoundErrorf(format string, a ...interface{}) error {
+	return &cliError{kind: notFoundError, msg: fmt.Sprintf(format, a...)}
+}
+
+// run adapts an error-returning task handler to the codegangsta/cli
+// ActionFunc signature: register commands as Action: run(createTask).
+func run(fn func(*cli.Context) error) func(*cli.Context) {
+	return func(ctx *cli.Context) {
+		if err := fn(ctx); err != nil {
+			exitWithError(ctx, err)
+		}
+	}
+}
+
+func exitWithError(ctx *cli.Context, err error) {
+	ce, ok := err.(*cliError)
+	if !ok {
+		ce = &cliError{kind: serverError, msg: err.Error()}
+	}
+
+	if ctx.GlobalString("output") == "json" {
+		b, _ := json.Marshal(struct {
+			Error string `json:"error"`
+			Kind  string `json:"kind"`
+		}{Error: ce.msg, Kind: ce.kind.jsonKind()})
+		fmt.Println(string(b))
+	} else {
+		fmt.Println(ce.msg)
+	}
+	os.Exit(ce.kind.exitCode())
+}
+
+type Formatter interface {
+	Format(v interface{}) (string, error)
+}
+
+func newFormatter(ctx *cli.Context) (Formatter, error) {
+	spec := ctx.GlobalString("output")
+	if spec == "" {
+		spec = "text"
+	}
+
+	switch {
+	case spec == "text":
+		return textFormatter{}, nil
+	case spec == "json":
+		return jsonFormatter{}, nil
+	case spec == "yaml":
+		return yamlFormatter{}, nil
+	case strings.HasPrefix(spec, "template="):
+		tmpl, err := template.New("output").Parse(strings.TrimPrefix(spec, "template="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --output template - %v", err)
+		}
+		return templateFormatter{tmpl: tmpl}, nil
+	default:
+		return nil, fmt.Errorf("unknown --output format %q (want text, json, yaml, or template=<go-template>)", spec)
+	}
+}
+
+type taskListRow struct {
+	ID                 interface{} `json:"id" yaml:"id"`
+	Name               string      `json:"name" yaml:"name"`
+	State              interface{} `json:"state" yaml:"state"`
+	HitCount           interface{} `json:"hit_count" yaml:"hit_count"`
+	MissCount          interface{} `json:"miss_count" yaml:"miss_count"`
+	FailedCount        interface{} `json:"failure_count" yaml:"failure_count"`
+	CreationTime       string      `json:"creation_time" yaml:"creation_time"`
+	LastFailureMessage interface{} `json:"last_failure_message,omitempty" yaml:"last_failure_message,omitempty"`
+}
+
+type taskSummary struct {
+	Action string      `json:"action" yaml:"action"`
+	ID     interface{} `json:"id" yaml:"id"`
+	Name   string      `json:"name,omitempty" yaml:"name,omitempty"`
+	State  interface{} `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+func printFormatted(ctx *cli.Context, v interface{}) error {
+	f, err := newFormatter(ctx)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	out, err := f.Format(v)
+	if err != nil {
+		return serverErrorf("error formatting output - %v", err)
+	}
+	fmt.Println(out)
+	return nil
+}
+
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(v interface{}) (string, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type yamlFormatter struct{}
+
+func (yamlFormatter) Format(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\n"), nil
+}
+
+type templateFormatter struct {
+	tmpl *template.Template
+}
+
+func (f templateFormatter) Format(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// textFormatter falls back to indented JSON for types it doesn't recognize.
+type textFormatter struct{}
+
+func (textFormatter) Format(v interface{}) (string, error) {
+	switch rows := v.(type) {
+	case []taskListRow:
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 0, 8, 1, '\t', 0)
+		printFields(w, false, 0,
+			"ID",
+			"NAME",
+			"STATE",
+			"HIT COUNT",
+			"MISS COUNT",
+			"FAILURE COUNT",
+			"CREATION TIME",
+			"LAST FAILURE MSG",
+		)
+		for _, row := range rows {
+			printFields(w, false, 0,
+				row.ID,
+				row.Name,
+				row.State,
+				row.HitCount,
+				row.MissCount,
+				row.FailedCount,
+				row.CreationTime,
+				row.LastFailureMessage,
+			)
+		}
+		w.Flush()
+		return strings.TrimRight(buf.String(), "\n"), nil
+
+	case []taskOpRow:
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 0, 8, 1, '\t', 0)
+		printFields(w, false, 0, "FILE", "NAME", "ACTION")
+		for _, row := range rows {
+			action := row.Action
+			if row.Error != "" {
+				action = fmt.Sprintf("error: %s", row.Error)
+			}
+			printFields(w, false, 0, row.File, row.Name, action)
+		}
+		w.Flush()
+		return strings.TrimRight(buf.String(), "\n"), nil
+
+	case taskSummary:
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "Task %s\n", rows.Action)
+		fmt.Fprintf(&buf, "ID: %v", rows.ID)
+		if rows.Name != "" {
+			fmt.Fprintf(&buf, "\nName: %s", rows.Name)
+		}
+		if rows.State != nil {
+			fmt.Fprintf(&buf, "\nState: %v", rows.State)
+		}
+		return buf.String(), nil
+
+	default:
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
 type task struct {
 	Version  int
 	Schedule *client.Schedule
@@ -26,111 +279,101 @@ type task struct {
 	Name     string
 }
 
-func createTask(ctx *cli.Context) {
-	if len(ctx.Args()) != 1 {
-		fmt.Print("Incorrect usage\n")
-		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
-	}
-
-	path := ctx.Args().First()
+// loadTaskFile reads a single task manifest from disk, sniffing YAML or
+// JSON from its extension the same way createTask always has. If the
+// manifest doesn't set a Name, it defaults to the file's base name so
+// directory-driven commands like applyTask have something to key on.
+func loadTaskFile(path string) (task, error) {
 	ext := filepath.Ext(path)
-	file, e := ioutil.ReadFile(path)
-	if e != nil {
-		fmt.Printf("File error - %v\n", e)
-		os.Exit(1)
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return task{}, fileErrorf("file error - %v", err)
 	}
 
 	t := task{}
 	switch ext {
 	case ".yaml", ".yml":
-		e = yaml.Unmarshal(file, &t)
-		if e != nil {
-			fmt.Printf("Error parsing YAML file input - %v\n", e)
-			os.Exit(1)
+		if err := yaml.Unmarshal(file, &t); err != nil {
+			return task{}, parseErrorf("error parsing YAML file input - %v", err)
 		}
 	case ".json":
-		e = json.Unmarshal(file, &t)
-		if e != nil {
-			fmt.Printf("Error parsing JSON file input - %v\n", e)
-			os.Exit(1)
+		if err := json.Unmarshal(file, &t); err != nil {
+			return task{}, parseErrorf("error parsing JSON file input - %v", err)
 		}
 	default:
-		fmt.Printf("Unsupported file type %s\n", ext)
-		os.Exit(1)
+		return task{}, usageErrorf("unsupported file type %s", ext)
+	}
+
+	if t.Name == "" {
+		t.Name = strings.TrimSuffix(filepath.Base(path), ext)
+	}
+	return t, nil
+}
+
+func createTask(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, ctx.Command.Name)
+		return usageErrorf("incorrect usage")
+	}
+
+	t, err := loadTaskFile(ctx.Args().First())
+	if err != nil {
+		return err
 	}
 
 	t.Name = ctx.String("name")
 	if t.Version != 1 {
-		fmt.Println("Invalid version provided")
-		os.Exit(1)
+		return parseErrorf("invalid version provided")
 	}
 
 	r := pClient.CreateTask(t.Schedule, t.Workflow, t.Name)
-
 	if r.Err != nil {
-		fmt.Printf("Error creating task:\n%v\n", r.Err)
-		os.Exit(1)
+		return serverErrorf("error creating task:\n%v", r.Err)
 	}
-	fmt.Println("Task created")
-	fmt.Printf("ID: %d\n", r.ID)
-	fmt.Printf("Name: %s\n", r.Name)
-	fmt.Printf("State: %s\n", r.State)
+	return printFormatted(ctx, taskSummary{Action: "created", ID: r.ID, Name: r.Name, State: r.State})
 }
 
-func listTask(ctx *cli.Context) {
+func listTask(ctx *cli.Context) error {
 	tasks := pClient.GetTasks()
 	if tasks.Err != nil {
-		fmt.Printf("Error getting tasks:\n%v\n", tasks.Err)
-		os.Exit(1)
-	}
-
-	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
-	printFields(w, false, 0,
-		"ID",
-		"NAME",
-		"STATE",
-		"HIT COUNT",
-		"MISS COUNT",
-		"FAILURE COUNT",
-		"CREATION TIME",
-		"LAST FAILURE MSG",
-	)
+		return serverErrorf("error getting tasks:\n%v", tasks.Err)
+	}
+
+	rows := make([]taskListRow, 0, len(tasks.ScheduledTasks))
 	for _, task := range tasks.ScheduledTasks {
-		printFields(w, false, 0,
-			task.ID,
-			task.Name,
-			task.State,
-			task.HitCount,
-			task.MissCount,
-			task.FailedCount,
-			task.CreationTime().Format(timeFormat),
-			task.LastFailureMessage,
-		)
+		rows = append(rows, taskListRow{
+			ID:                 task.ID,
+			Name:               task.Name,
+			State:              task.State,
+			HitCount:           task.HitCount,
+			MissCount:          task.MissCount,
+			FailedCount:        task.FailedCount,
+			CreationTime:       task.CreationTime().Format(timeFormat),
+			LastFailureMessage: task.LastFailureMessage,
+		})
 	}
-	w.Flush()
+	return printFormatted(ctx, rows)
 }
 
-func watchTask(ctx *cli.Context) {
+func watchTask(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
-		fmt.Print("Incorrect usage\n")
 		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
+		return usageErrorf("incorrect usage")
 	}
 
 	id, err := strconv.ParseUint(ctx.Args().First(), 0, 64)
 	if err != nil {
-		fmt.Printf("Incorrect usage - %v\n", err.Error())
 		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
+		return usageErrorf("incorrect usage - %v", err)
 	}
 	r := pClient.WatchTask(uint(id))
 	if r.Err != nil {
-		fmt.Printf("Error starting task:\n%v\n", r.Err)
 		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
+		return serverErrorf("error starting task:\n%v", r.Err)
+	}
+	if err := printFormatted(ctx, taskSummary{Action: "watching", ID: id}); err != nil {
+		return err
 	}
-	fmt.Printf("Watching Task (%d):\n", id)
 
 	// catch interrupt so we signal the server we are done before exiting
 	c := make(chan os.Signal, 1)
@@ -160,87 +403,637 @@ func watchTask(ctx *cli.Context) {
 			}
 
 		case <-r.DoneChan:
-			return
+			return nil
 		}
 	}
+}
 
+// sinceAllowsEvent reports whether a metric event collected at any of the
+// given timestamps is recent enough to pass a --since filter. The cutoff is
+// computed against now rather than once at startup, since events arrive
+// live rather than being replayed from a fixed point in the past.
+func sinceAllowsEvent(now time.Time, since time.Duration, timestamps []time.Time) bool {
+	if since <= 0 {
+		return true
+	}
+	cutoff := now.Add(-since)
+	for _, t := range timestamps {
+		if t.After(cutoff) {
+			return true
+		}
+	}
+	return false
 }
 
-func startTask(ctx *cli.Context) {
+// matchesNamespaceFilter reports whether any of the given metric namespaces
+// matches a --filter glob pattern. An empty filter matches everything.
+// A pattern that matches a namespace also matches every namespace beneath
+// it, so "/intel/cpu/*" matches "/intel/cpu/0/utilization".
+func matchesNamespaceFilter(filter string, namespaces []string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, ns := range namespaces {
+		for i := 1; i <= len(ns); i++ {
+			if i < len(ns) && ns[i] != '/' {
+				continue
+			}
+			if ok, _ := path.Match(filter, ns[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// waitBackoff sleeps for d, returning early (and false) if stop fires first.
+func waitBackoff(d time.Duration, stop <-chan os.Signal) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		fmt.Println("Stopping task watch")
+		return false
+	}
+}
+
+func logsTask(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
-		fmt.Print("Incorrect usage\n")
 		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
+		return usageErrorf("incorrect usage")
 	}
 
 	id, err := strconv.ParseUint(ctx.Args().First(), 0, 64)
 	if err != nil {
-		fmt.Printf("Incorrect usage - %v\n", err.Error())
-		os.Exit(1)
+		cli.ShowCommandHelp(ctx, ctx.Command.Name)
+		return usageErrorf("incorrect usage - %v", err)
+	}
+
+	since := time.Duration(0)
+	if s := ctx.String("since"); s != "" {
+		since, err = time.ParseDuration(s)
+		if err != nil {
+			return usageErrorf("incorrect usage - invalid --since duration %q - %v", s, err)
+		}
+	}
+
+	filter := ctx.String("filter")
+	format := ctx.String("format")
+	switch format {
+	case "", "text", "json":
+		// ok
+	default:
+		return usageErrorf("unknown --format %q (want text or json)", format)
+	}
+	follow := ctx.Bool("follow")
+
+	// catch interrupt so we signal the server we are done before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, syscall.SIGTERM)
+
+	interrupted := false
+	backoff := time.Second
+	firstAttempt := true
+	for !interrupted {
+		r := pClient.WatchTask(uint(id))
+		if r.Err != nil {
+			if firstAttempt {
+				cli.ShowCommandHelp(ctx, ctx.Command.Name)
+				return serverErrorf("error starting task watch:\n%v", r.Err)
+			}
+			fmt.Printf("Watch reconnect failed, retrying in %s: %v\n", backoff, r.Err)
+			if !waitBackoff(backoff, stop) {
+				return nil
+			}
+			backoff *= 2
+			if backoff > maxWatchBackoff {
+				backoff = maxWatchBackoff
+			}
+			continue
+		}
+		firstAttempt = false
+		fmt.Printf("Watching Task (%d):\n", id)
+
+		closed := make(chan struct{})
+		go func() {
+			select {
+			case <-stop:
+				fmt.Println("Stopping task watch")
+				interrupted = true
+				r.Close()
+			case <-closed:
+			}
+		}()
+
+		// Loop listening to events until the server closes the watch
+	readLoop:
+		for {
+			select {
+			case e := <-r.EventChan:
+				if e.EventType == "metric-event" {
+					timestamps := make([]time.Time, len(e.Event))
+					namespaces := make([]string, len(e.Event))
+					for i, m := range e.Event {
+						timestamps[i] = m.Timestamp
+						namespaces[i] = m.Namespace.String()
+					}
+					if !sinceAllowsEvent(time.Now(), since, timestamps) || !matchesNamespaceFilter(filter, namespaces) {
+						continue
+					}
+				}
+
+				if format == "json" {
+					b, jerr := json.Marshal(e)
+					if jerr != nil {
+						fmt.Printf("Error marshalling event - %v\n", jerr)
+						continue
+					}
+					fmt.Println(string(b))
+					continue
+				}
+
+				switch e.EventType {
+				case "metric-event":
+					out := "[metrics collected] "
+					p := make([]string, len(e.Event))
+					for i := range e.Event {
+						p[i] = fmt.Sprintf("%s=%+v", e.Event[i].Namespace, e.Event[i].Data)
+					}
+					out += strings.Join(p, " ")
+					fmt.Println(out)
+				default:
+					fmt.Printf("[%s]\n", e.EventType)
+				}
+
+			case <-r.DoneChan:
+				break readLoop
+			}
+		}
+		close(closed)
+
+		if interrupted || !follow {
+			return nil
+		}
+
+		fmt.Printf("Watch connection dropped, reconnecting in %s\n", backoff)
+		if !waitBackoff(backoff, stop) {
+			return nil
+		}
+		backoff *= 2
+		if backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+	return nil
+}
+
+func startTask(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, ctx.Command.Name)
+		return usageErrorf("incorrect usage")
+	}
+
+	id, err := strconv.ParseUint(ctx.Args().First(), 0, 64)
+	if err != nil {
+		return usageErrorf("incorrect usage - %v", err)
 	}
 	r := pClient.StartTask(int(id))
 	if r.Err != nil {
-		fmt.Printf("Error starting task:\n%v\n", r.Err)
-		os.Exit(1)
+		return serverErrorf("error starting task:\n%v", r.Err)
 	}
-	fmt.Println("Task started:")
-	fmt.Printf("ID: %d\n", r.ID)
+	return printFormatted(ctx, taskSummary{Action: "started", ID: r.ID})
 }
 
-func stopTask(ctx *cli.Context) {
+func stopTask(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
-		fmt.Print("Incorrect usage\n")
 		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
+		return usageErrorf("incorrect usage")
 	}
 
 	id, err := strconv.ParseUint(ctx.Args().First(), 0, 64)
 	if err != nil {
-		fmt.Printf("Incorrect usage - %v\n", err.Error())
-		os.Exit(1)
+		return usageErrorf("incorrect usage - %v", err)
 	}
 	r := pClient.StopTask(int(id))
 	if r.Err != nil {
-		fmt.Printf("Error stopping task:\n%v\n", r.Err)
-		os.Exit(1)
+		return serverErrorf("error stopping task:\n%v", r.Err)
 	}
-	fmt.Println("Task stopped:")
-	fmt.Printf("ID: %d\n", r.ID)
+	return printFormatted(ctx, taskSummary{Action: "stopped", ID: r.ID})
 }
 
-func removeTask(ctx *cli.Context) {
+func removeTask(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
-		fmt.Print("Incorrect usage\n")
 		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
+		return usageErrorf("incorrect usage")
 	}
 
 	id, err := strconv.ParseUint(ctx.Args().First(), 0, 64)
 	if err != nil {
-		fmt.Printf("Incorrect usage - %v\n", err.Error())
-		os.Exit(1)
+		return usageErrorf("incorrect usage - %v", err)
 	}
 	r := pClient.RemoveTask(int(id))
 	if r.Err != nil {
-		fmt.Printf("Error stopping task:\n%v\n", r.Err)
-		os.Exit(1)
+		return serverErrorf("error removing task:\n%v", r.Err)
+	}
+	return printFormatted(ctx, taskSummary{Action: "removed", ID: r.ID})
+}
+
+// taskApplyConcurrency bounds how many manifest files applyTask/destroyTask
+// act on at once.
+const taskApplyConcurrency = 8
+
+func taskManifestFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+type taskOpResult struct {
+	File   string
+	Name   string
+	Action string
+	Err    error
+}
+
+// runTaskOps fans op out across a worker pool, returning results in the
+// same order as files regardless of completion order.
+func runTaskOps(files []string, op func(string) taskOpResult) []taskOpResult {
+	results := make([]taskOpResult, len(files))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < taskApplyConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = op(files[i])
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+type taskOpRow struct {
+	File   string `json:"file" yaml:"file"`
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"`
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+	Error  string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func printTaskOpResults(ctx *cli.Context, results []taskOpResult) error {
+	rows := make([]taskOpRow, len(results))
+	for i, r := range results {
+		row := taskOpRow{File: r.File, Name: r.Name, Action: r.Action}
+		if r.Err != nil {
+			row.Error = r.Err.Error()
+		}
+		rows[i] = row
+	}
+	return printFormatted(ctx, rows)
+}
+
+// runningTasksByName maps task Name to ID for every task currently known to
+// snapd.
+func runningTasksByName() (map[string]uint, error) {
+	tasks := pClient.GetTasks()
+	if tasks.Err != nil {
+		return nil, tasks.Err
+	}
+	byName := make(map[string]uint, len(tasks.ScheduledTasks))
+	for _, st := range tasks.ScheduledTasks {
+		byName[st.Name] = st.ID
 	}
-	fmt.Println("Task removed:")
-	fmt.Printf("ID: %d\n", r.ID)
+	return byName, nil
 }
 
-func exportTask(ctx *cli.Context) {
+// workflowsEqual reports whether two workflows describe the same desired
+// state for applyTask's diff. A manifest that leaves a plugin/collector
+// version at 0 ("latest") is compared loosely on that node, since the
+// server always resolves it to a concrete version before returning it -
+// otherwise every apply of such a manifest would look changed and
+// needlessly remove+recreate the task.
+func workflowsEqual(remote, local *wmap.WorkflowMap) bool {
+	if remote == nil || local == nil {
+		return remote == local
+	}
+	return metricsEqual(remote.Collect.Metrics, local.Collect.Metrics) &&
+		processNodesEqual(remote.Collect.Process, local.Collect.Process) &&
+		publishNodesEqual(remote.Collect.Publish, local.Collect.Publish)
+}
+
+func metricsEqual(remote, local map[string]int) bool {
+	if len(remote) != len(local) {
+		return false
+	}
+	for ns, localVer := range local {
+		remoteVer, ok := remote[ns]
+		if !ok {
+			return false
+		}
+		if localVer != 0 && remoteVer != localVer {
+			return false
+		}
+	}
+	return true
+}
+
+func processNodesEqual(remote, local []wmap.ProcessWorkflowMapNode) bool {
+	if len(remote) != len(local) {
+		return false
+	}
+	for i, l := range local {
+		r := remote[i]
+		if r.PluginName != l.PluginName {
+			return false
+		}
+		if l.PluginVersion != 0 && r.PluginVersion != l.PluginVersion {
+			return false
+		}
+		if !processNodesEqual(r.Process, l.Process) || !publishNodesEqual(r.Publish, l.Publish) {
+			return false
+		}
+	}
+	return true
+}
+
+func publishNodesEqual(remote, local []wmap.PublishWorkflowMapNode) bool {
+	if len(remote) != len(local) {
+		return false
+	}
+	for i, l := range local {
+		r := remote[i]
+		if r.PluginName != l.PluginName {
+			return false
+		}
+		if l.PluginVersion != 0 && r.PluginVersion != l.PluginVersion {
+			return false
+		}
+	}
+	return true
+}
+
+func applyTask(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
-		fmt.Print("Incorrect usage\n")
 		cli.ShowCommandHelp(ctx, ctx.Command.Name)
-		os.Exit(1)
+		return usageErrorf("incorrect usage")
+	}
+
+	files, err := taskManifestFiles(ctx.Args().First())
+	if err != nil {
+		return fileErrorf("error reading manifest directory - %v", err)
+	}
+
+	byName, err := runningTasksByName()
+	if err != nil {
+		return serverErrorf("error getting tasks:\n%v", err)
+	}
+
+	dryRun := ctx.Bool("dry-run")
+	results := runTaskOps(files, func(file string) taskOpResult {
+		t, err := loadTaskFile(file)
+		if err != nil {
+			return taskOpResult{File: file, Err: err}
+		}
+
+		id, exists := byName[t.Name]
+		if !exists {
+			if dryRun {
+				return taskOpResult{File: file, Name: t.Name, Action: "create (dry-run)"}
+			}
+			r := pClient.CreateTask(t.Schedule, t.Workflow, t.Name)
+			if r.Err != nil {
+				return taskOpResult{File: file, Name: t.Name, Err: r.Err}
+			}
+			return taskOpResult{File: file, Name: t.Name, Action: "created"}
+		}
+
+		remote := pClient.GetTask(id)
+		if remote.Err != nil {
+			// A failed fetch means we can't tell whether an update is even
+			// needed - report it as its own error instead of falling through
+			// to the destructive remove+recreate path below.
+			return taskOpResult{File: file, Name: t.Name, Err: fmt.Errorf("could not fetch existing task to diff - %v", remote.Err)}
+		}
+		if reflect.DeepEqual(remote.Schedule, t.Schedule) && workflowsEqual(remote.Workflow, t.Workflow) {
+			return taskOpResult{File: file, Name: t.Name, Action: "unchanged"}
+		}
+		if dryRun {
+			return taskOpResult{File: file, Name: t.Name, Action: "update (dry-run)"}
+		}
+		// pClient has no update call, so converge by removing and recreating.
+		// If the create fails after the remove has already succeeded, try to
+		// restore the task from its pre-update schedule/workflow rather than
+		// leaving it permanently gone.
+		if r := pClient.RemoveTask(int(id)); r.Err != nil {
+			return taskOpResult{File: file, Name: t.Name, Err: r.Err}
+		}
+		r := pClient.CreateTask(t.Schedule, t.Workflow, t.Name)
+		if r.Err != nil {
+			if rb := pClient.CreateTask(remote.Schedule, remote.Workflow, t.Name); rb.Err != nil {
+				return taskOpResult{File: file, Name: t.Name, Err: fmt.Errorf("update failed (%v) and rollback to the previous task also failed (%v) - task %q no longer exists", r.Err, rb.Err, t.Name)}
+			}
+			return taskOpResult{File: file, Name: t.Name, Err: fmt.Errorf("update failed, rolled back to the previous task - %v", r.Err)}
+		}
+		return taskOpResult{File: file, Name: t.Name, Action: "updated"}
+	})
+
+	return printTaskOpResults(ctx, results)
+}
+
+func destroyTask(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, ctx.Command.Name)
+		return usageErrorf("incorrect usage")
+	}
+
+	files, err := taskManifestFiles(ctx.Args().First())
+	if err != nil {
+		return fileErrorf("error reading manifest directory - %v", err)
+	}
+
+	byName, err := runningTasksByName()
+	if err != nil {
+		return serverErrorf("error getting tasks:\n%v", err)
+	}
+
+	dryRun := ctx.Bool("dry-run")
+	results := runTaskOps(files, func(file string) taskOpResult {
+		t, err := loadTaskFile(file)
+		if err != nil {
+			return taskOpResult{File: file, Err: err}
+		}
+
+		id, exists := byName[t.Name]
+		if !exists {
+			return taskOpResult{File: file, Name: t.Name, Action: "absent"}
+		}
+		if dryRun {
+			return taskOpResult{File: file, Name: t.Name, Action: "destroy (dry-run)"}
+		}
+		if r := pClient.RemoveTask(int(id)); r.Err != nil {
+			return taskOpResult{File: file, Name: t.Name, Err: r.Err}
+		}
+		return taskOpResult{File: file, Name: t.Name, Action: "destroyed"}
+	})
+
+	return printTaskOpResults(ctx, results)
+}
+
+func exportTask(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, ctx.Command.Name)
+		return usageErrorf("incorrect usage")
 	}
 	id, err := strconv.ParseUint(ctx.Args().First(), 0, 32)
 	if err != nil {
-		fmt.Printf("Incorrect usage - %v\n", err.Error())
-		os.Exit(1)
+		return usageErrorf("incorrect usage - %v", err)
 	}
 	task := pClient.GetTask(uint(id))
-	tb, err := json.Marshal(task)
-	fmt.Println(string(tb))
+	if task.Err != nil {
+		return serverErrorf("error getting task:\n%v", task.Err)
+	}
+
+	switch format := ctx.String("format"); format {
+	case "":
+		return printFormatted(ctx, task)
+	case "json":
+		out, err := (jsonFormatter{}).Format(task)
+		if err != nil {
+			return serverErrorf("error formatting output - %v", err)
+		}
+		fmt.Println(out)
+	case "yaml":
+		out, err := (yamlFormatter{}).Format(task)
+		if err != nil {
+			return serverErrorf("error formatting output - %v", err)
+		}
+		fmt.Println(out)
+	default:
+		return usageErrorf("unknown --format %q (want json or yaml)", format)
+	}
+	return nil
+}
+
+type pluginRef struct {
+	Kind    string
+	Name    string
+	Version int
+}
+
+type metricRef struct {
+	Namespace string
+	Version   int
+}
+
+func collectMetricRefs(w *wmap.WorkflowMap) []metricRef {
+	if w == nil {
+		return nil
+	}
+
+	refs := make([]metricRef, 0, len(w.Collect.Metrics))
+	for ns, ver := range w.Collect.Metrics {
+		refs = append(refs, metricRef{Namespace: ns, Version: ver})
+	}
+	return refs
+}
+
+// collectPluginRefs only walks process/publish nodes - collectors are
+// handled separately by collectMetricRefs since a workflow selects them by
+// metric namespace rather than by plugin name/version.
+func collectPluginRefs(w *wmap.WorkflowMap) []pluginRef {
+	if w == nil {
+		return nil
+	}
+
+	var refs []pluginRef
+	var walkProcess func(nodes []wmap.ProcessWorkflowMapNode)
+	var walkPublish func(nodes []wmap.PublishWorkflowMapNode)
+
+	walkProcess = func(nodes []wmap.ProcessWorkflowMapNode) {
+		for _, n := range nodes {
+			refs = append(refs, pluginRef{Kind: "processor", Name: n.PluginName, Version: n.PluginVersion})
+			walkProcess(n.Process)
+			walkPublish(n.Publish)
+		}
+	}
+	walkPublish = func(nodes []wmap.PublishWorkflowMapNode) {
+		for _, n := range nodes {
+			refs = append(refs, pluginRef{Kind: "publisher", Name: n.PluginName, Version: n.PluginVersion})
+		}
+	}
+
+	walkProcess(w.Collect.Process)
+	walkPublish(w.Collect.Publish)
+	return refs
+}
+
+func validateTask(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		cli.ShowCommandHelp(ctx, ctx.Command.Name)
+		return usageErrorf("incorrect usage")
+	}
+
+	t, err := loadTaskFile(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	manifestValid := true
+	if t.Version != 1 {
+		fmt.Println("Invalid version provided")
+		manifestValid = false
+	}
+	if t.Workflow == nil || len(t.Workflow.Collect.Metrics) == 0 {
+		fmt.Println("Workflow declares no metrics to collect")
+		manifestValid = false
+	}
+
+	missingPlugins := false
+	for _, ref := range collectPluginRefs(t.Workflow) {
+		p := pClient.GetPlugin(ref.Kind, ref.Name, ref.Version)
+		if p.Err != nil {
+			fmt.Printf("Missing %s plugin %s v%d\n", ref.Kind, ref.Name, ref.Version)
+			missingPlugins = true
+		}
+	}
+
+	missingCollectors := false
+	for _, ref := range collectMetricRefs(t.Workflow) {
+		m := pClient.FetchMetrics(ref.Namespace, ref.Version)
+		if m.Err != nil {
+			fmt.Printf("Missing collector metric %s v%d\n", ref.Namespace, ref.Version)
+			missingCollectors = true
+		}
+	}
+
+	switch {
+	case !manifestValid:
+		return parseErrorf("task manifest is invalid")
+	case missingPlugins, missingCollectors:
+		return notFoundErrorf("task references plugins or collected metrics not available on snapd")
+	}
+	fmt.Println("Task manifest is valid")
+	return nil
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/pulse/scheduler/wmap"
+)
+
+func TestSinceAllowsEvent(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		since      time.Duration
+		timestamps []time.Time
+		want       bool
+	}{
+		{"no since filters nothing", 0, []time.Time{now.Add(-time.Hour)}, true},
+		{"recent event within window", time.Minute, []time.Time{now.Add(-30 * time.Second)}, true},
+		{"stale event outside window", time.Minute, []time.Time{now.Add(-2 * time.Minute)}, false},
+		{"one recent metric among stale ones", time.Minute, []time.Time{now.Add(-time.Hour), now.Add(-time.Second)}, true},
+		{"no metrics", time.Minute, nil, false},
+	}
+
+	for _, c := range cases {
+		if got := sinceAllowsEvent(now, c.since, c.timestamps); got != c.want {
+			t.Errorf("%s: sinceAllowsEvent() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMatchesNamespaceFilter(t *testing.T) {
+	cases := []struct {
+		name       string
+		filter     string
+		namespaces []string
+		want       bool
+	}{
+		{"empty filter matches everything", "", nil, true},
+		{"exact match", "/intel/cpu/0/utilization", []string{"/intel/cpu/0/utilization"}, true},
+		{"glob match", "/intel/cpu/*", []string{"/intel/cpu/0/utilization"}, true},
+		{"no match", "/intel/cpu/*", []string{"/intel/mem/free"}, false},
+		{"matches any of several namespaces", "/intel/mem/*", []string{"/intel/cpu/0/utilization", "/intel/mem/free"}, true},
+	}
+
+	for _, c := range cases {
+		if got := matchesNamespaceFilter(c.filter, c.namespaces); got != c.want {
+			t.Errorf("%s: matchesNamespaceFilter() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRunTaskOpsPreservesOrder(t *testing.T) {
+	files := []string{"c.yaml", "a.yaml", "b.yaml", "d.yaml", "e.yaml"}
+	results := runTaskOps(files, func(file string) taskOpResult {
+		return taskOpResult{File: file, Action: "done"}
+	})
+
+	if len(results) != len(files) {
+		t.Fatalf("got %d results, want %d", len(results), len(files))
+	}
+	for i, file := range files {
+		if results[i].File != file {
+			t.Errorf("result %d = %q, want %q", i, results[i].File, file)
+		}
+	}
+}
+
+func TestWorkflowsEqual(t *testing.T) {
+	remote := &wmap.WorkflowMap{}
+	remote.Collect.Metrics = map[string]int{"/intel/cpu/0/utilization": 5}
+	remote.Collect.Process = []wmap.ProcessWorkflowMapNode{
+		{PluginName: "passthru", PluginVersion: 2},
+	}
+
+	unpinned := &wmap.WorkflowMap{}
+	unpinned.Collect.Metrics = map[string]int{"/intel/cpu/0/utilization": 0}
+	unpinned.Collect.Process = []wmap.ProcessWorkflowMapNode{
+		{PluginName: "passthru", PluginVersion: 0},
+	}
+	if !workflowsEqual(remote, unpinned) {
+		t.Error("expected an unpinned (version 0) manifest to be unchanged against a resolved remote workflow")
+	}
+
+	pinnedDifferent := &wmap.WorkflowMap{}
+	pinnedDifferent.Collect.Metrics = map[string]int{"/intel/cpu/0/utilization": 1}
+	pinnedDifferent.Collect.Process = remote.Collect.Process
+	if workflowsEqual(remote, pinnedDifferent) {
+		t.Error("expected a manifest pinned to a different version to be reported as changed")
+	}
+}
+
+func TestCliErrorKindMapping(t *testing.T) {
+	cases := []struct {
+		kind     cliErrorKind
+		wantExit int
+		wantJSON string
+	}{
+		{usageError, 2, "usage"},
+		{fileIOError, 3, "file_io"},
+		{parseError, 4, "parse"},
+		{serverError, 5, "server"},
+		{notFoundError, 6, "not_found"},
+	}
+
+	for _, c := range cases {
+		if got := c.kind.exitCode(); got != c.wantExit {
+			t.Errorf("%v.exitCode() = %d, want %d", c.kind, got, c.wantExit)
+		}
+		if got := c.kind.jsonKind(); got != c.wantJSON {
+			t.Errorf("%v.jsonKind() = %q, want %q", c.kind, got, c.wantJSON)
+		}
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	out, err := (jsonFormatter{}).Format(taskSummary{Action: "created", ID: 42})
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+	if !strings.Contains(out, `"action": "created"`) || !strings.Contains(out, `"id": 42`) {
+		t.Errorf("Format() = %q, missing expected fields", out)
+	}
+}
+
+func TestTextFormatterTaskSummary(t *testing.T) {
+	out, err := (textFormatter{}).Format(taskSummary{Action: "started", ID: 7, Name: "foo"})
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+	for _, want := range []string{"Task started", "ID: 7", "Name: foo"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Format() = %q, want it to contain %q", out, want)
+		}
+	}
+}
+
+func TestCollectMetricRefs(t *testing.T) {
+	w := &wmap.WorkflowMap{}
+	w.Collect.Metrics = map[string]int{
+		"/intel/cpu/0/utilization": 2,
+		"/intel/mem/free":          0,
+	}
+
+	refs := collectMetricRefs(w)
+	got := map[string]int{}
+	for _, r := range refs {
+		got[r.Namespace] = r.Version
+	}
+	if len(got) != 2 || got["/intel/cpu/0/utilization"] != 2 || got["/intel/mem/free"] != 0 {
+		t.Errorf("collectMetricRefs() = %+v, want %+v", got, w.Collect.Metrics)
+	}
+
+	if collectMetricRefs(nil) != nil {
+		t.Error("collectMetricRefs(nil) should return nil")
+	}
+}
+
+func TestCollectPluginRefs(t *testing.T) {
+	w := &wmap.WorkflowMap{}
+	w.Collect.Process = []wmap.ProcessWorkflowMapNode{
+		{
+			PluginName:    "movingaverage",
+			PluginVersion: 1,
+			Publish: []wmap.PublishWorkflowMapNode{
+				{PluginName: "file", PluginVersion: 3},
+			},
+		},
+	}
+	w.Collect.Publish = []wmap.PublishWorkflowMapNode{
+		{PluginName: "influxdb", PluginVersion: 2},
+	}
+
+	refs := collectPluginRefs(w)
+	want := []pluginRef{
+		{Kind: "processor", Name: "movingaverage", Version: 1},
+		{Kind: "publisher", Name: "file", Version: 3},
+		{Kind: "publisher", Name: "influxdb", Version: 2},
+	}
+	if len(refs) != len(want) {
+		t.Fatalf("collectPluginRefs() returned %d refs, want %d: %+v", len(refs), len(want), refs)
+	}
+	for i, w := range want {
+		if refs[i] != w {
+			t.Errorf("ref %d = %+v, want %+v", i, refs[i], w)
+		}
+	}
+
+	if collectPluginRefs(nil) != nil {
+		t.Error("collectPluginRefs(nil) should return nil")
+	}
+}
+
+func TestTextFormatterTaskOpRows(t *testing.T) {
+	out, err := (textFormatter{}).Format([]taskOpRow{
+		{File: "a.yaml", Name: "task-a", Action: "created"},
+		{File: "b.yaml", Name: "task-b", Error: "boom"},
+	})
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+	if !strings.Contains(out, "created") || !strings.Contains(out, "error: boom") {
+		t.Errorf("Format() = %q, missing expected rows", out)
+	}
+}